@@ -2,52 +2,140 @@ package lr
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"github.com/xlvector/hector/core"
 	"github.com/xlvector/hector/util"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
 	"math"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
 )
 
 type EPLogisticRegressionParams struct {
 	init_var, beta float64
 }
 
+// decayToPrior applies the eq-14/15 decay step used throughout this
+// package: blend wi toward the zero-mean prior at variance init_var,
+// weighted stay (fraction kept) vs toPrior (fraction decayed back). The
+// fixed per-sample split used by Train/Observe/Rank is 0.99/0.01;
+// DecayElapsed instead scales it by elapsed idle time.
+func (algo *EPLogisticRegression) decayToPrior(wi *util.Gaussian, stay, toPrior float64) {
+	wi0Vari := algo.params.init_var
+	wiVari := wi.Vari
+	newVari := wiVari * wi0Vari / (stay*wi0Vari + toPrior*wiVari)
+	wi.Mean = newVari * stay * wi.Mean / wiVari
+	wi.Vari = newVari
+	if wi.Vari < algo.params.init_var*0.01 {
+		wi.Vari = algo.params.init_var * 0.01
+	}
+}
+
 type EPLogisticRegression struct {
 	Model  map[int64]*util.Gaussian
 	params EPLogisticRegressionParams
+
+	// modelMu guards Model wherever it can plausibly be touched from more
+	// than one goroutine at once: TrainParallel's worker pool, the
+	// streaming/ranking writers (Observe, Rank, DecayElapsed) and the
+	// read-only prediction calls (PredictWithVariance, ShouldQuery,
+	// PredictPair) a serving loop might call alongside them. Train and
+	// Predict are the original single-call batch paths and don't take it.
+	modelMu sync.RWMutex
 }
 
+// SaveModel writes algo to path with TextModelCodec, framed by the magic
+// header and checksum trailer of SaveModelWithCodec. Callers that
+// want gob or varint persistence should use SaveModelWithCodec directly;
+// this keeps the pre-ModelCodec signature working for existing callers that
+// can't handle an error return.
 func (algo *EPLogisticRegression) SaveModel(path string) {
-	sb := util.StringBuilder{}
-	for f, g := range algo.Model {
-		sb.Int64(f)
-		sb.Write("\t")
-		sb.Float(g.Mean)
-		sb.Write("\t")
-		sb.Float(g.Vari)
-		sb.Write("\n")
-	}
-	sb.WriteToFile(path)
+	if err := algo.SaveModelWithCodec(path, TextModelCodec{}); err != nil {
+		log.Printf("lr: SaveModel %s: %v", path, err)
+	}
 }
 
-func (algo *EPLogisticRegression) LoadModel(path string) {
-	file, _ := os.Open(path)
+// SaveModelWithCodec writes algo to path using codec, prefixed with codec's
+// magic number and trailed with a CRC32 checksum of the encoded body (see
+// ModelCodec). A nil codec defaults to TextModelCodec.
+func (algo *EPLogisticRegression) SaveModelWithCodec(path string, codec ModelCodec) error {
+	if codec == nil {
+		codec = TextModelCodec{}
+	}
+
+	var body bytes.Buffer
+	if err := codec.Encode(&body, algo); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
-	scaner := bufio.NewScanner(file)
-	for scaner.Scan() {
-		line := scaner.Text()
-		tks := strings.Split(line, "\t")
-		fid, _ := strconv.ParseInt(tks[0], 10, 64)
-		mean, _ := strconv.ParseFloat(tks[1], 64)
-		vari, _ := strconv.ParseFloat(tks[2], 64)
-		g := util.Gaussian{Mean: mean, Vari: vari}
-		algo.Model[fid] = &g
+	w := bufio.NewWriter(file)
+	if err := binary.Write(w, binary.BigEndian, codec.Magic()); err != nil {
+		return err
+	}
+	if _, err := w.Write(body.Bytes()); err != nil {
+		return err
+	}
+	checksum := crc32.ChecksumIEEE(body.Bytes())
+	if err := binary.Write(w, binary.BigEndian, checksum); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// LoadModel reads the magic-number header written by SaveModel/
+// SaveModelWithCodec to pick the right ModelCodec, verifies the checksum
+// trailer and decodes beta/init_var along with the weights, so Predict
+// works immediately after loading. Kept error-less to match the
+// pre-ModelCodec signature; failures are logged rather than returned.
+func (algo *EPLogisticRegression) LoadModel(path string) {
+	if err := algo.loadModel(path); err != nil {
+		log.Printf("lr: LoadModel %s: %v", path, err)
 	}
 }
 
+func (algo *EPLogisticRegression) loadModel(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < 8 {
+		return errors.New("lr: model file too short")
+	}
+
+	magic := binary.BigEndian.Uint32(data[:4])
+	checksum := binary.BigEndian.Uint32(data[len(data)-4:])
+	body := data[4 : len(data)-4]
+	if crc32.ChecksumIEEE(body) != checksum {
+		return errors.New("lr: model file checksum mismatch")
+	}
+
+	codec, err := codecForMagic(magic)
+	if err != nil {
+		return err
+	}
+
+	decoded, err := codec.Decode(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// assign fields individually rather than `*algo = *decoded`, which would
+	// copy algo.modelMu by value
+	algo.Model = decoded.Model
+	algo.params = decoded.params
+	return nil
+}
+
 func (algo *EPLogisticRegression) Predict(sample *core.Sample) float64 {
 	s := util.Gaussian{Mean: 0.0, Vari: 0.0}
 	for _, feature := range sample.Features {
@@ -79,6 +167,14 @@ func (algo *EPLogisticRegression) Clear() {
 }
 
 func (algo *EPLogisticRegression) Train(dataset *core.DataSet) {
+	algo.train(dataset, true)
+}
+
+// train is Train's body, with the per-sample eq-14/15 decay step made
+// optional so TrainParallel's trainBatch can reuse the exact same EP update
+// without also decaying -- it already applies decay once per epoch itself
+// (see decayModel), not once per sample occurrence like the serial path.
+func (algo *EPLogisticRegression) train(dataset *core.DataSet, decay bool) {
 	// http://tullo.ch/articles/online-learning-with-adpredictor/
 	// http://videolectures.net/acml2013_herbrich_real_time_bayesian_learning/
 	// http://www.moserware.com/2010/03/computing-your-skill.html
@@ -153,7 +249,6 @@ func (algo *EPLogisticRegression) Train(dataset *core.DataSet) {
 			if feature.Value == 0.0 {
 				continue
 			}
-			wi0 := util.Gaussian{Mean: 0.0, Vari: algo.params.init_var}
 			w2 := util.Gaussian{Mean: 0.0, Vari: 0.0}
 			wi, _ := algo.Model[feature.Id]
 			// remove the current term/feature's values from s0 (step 2 of EP)
@@ -163,15 +258,11 @@ func (algo *EPLogisticRegression) Train(dataset *core.DataSet) {
 			w2.Mean = (s.Mean - (s0.Mean - wi.Mean*feature.Value)) / feature.Value
 			w2.Vari = (s.Vari + (s0.Vari - wi.Vari*feature.Value*feature.Value)) / (feature.Value * feature.Value)
 			wi.MultGaussian(&w2)
-			wi_vari := wi.Vari
-
-			// these are eq 14 and 15
-			// purpose is to decay past data over time and move it back to prior if no new data
-			wi_new_vari := wi_vari * wi0.Vari / (0.99*wi0.Vari + 0.01*wi.Vari)
-			wi.Vari = wi_new_vari
-			wi.Mean = wi.Vari * (0.99*wi.Mean/wi_vari + 0.01*wi0.Mean/wi.Vari)
-			if wi.Vari < algo.params.init_var*0.01 {
-				wi.Vari = algo.params.init_var * 0.01
+
+			if decay {
+				// eq 14 and 15: decay past data over time and move it back
+				// to the prior if no new data (see decayToPrior)
+				algo.decayToPrior(wi, 0.99, 0.01)
 			}
 			algo.Model[feature.Id] = wi
 		}
@@ -0,0 +1,152 @@
+package lr
+
+import (
+	"github.com/xlvector/hector/core"
+	"github.com/xlvector/hector/util"
+	"sync"
+)
+
+// TrainParallel splits dataset.Samples into grainSize batches and processes
+// them across numWorkers goroutines. Each worker runs the same per-sample EP
+// update as Train against its own batch, producing a delta-Gaussian per
+// touched feature; deltas are merged into algo.Model under algo.modelMu,
+// then the eq-14/15 decay step is applied once for the whole epoch (instead
+// of once per sample, as Train does it).
+func (algo *EPLogisticRegression) TrainParallel(dataset *core.DataSet, numWorkers int, grainSize int) {
+	batches := batchSamples(dataset.Samples, grainSize)
+
+	sendWork := make(chan []*core.Sample, len(batches))
+	receiveWork := make(chan map[int64]util.Gaussian, len(batches))
+
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range sendWork {
+				receiveWork <- algo.trainBatch(batch)
+			}
+		}()
+	}
+
+	for _, batch := range batches {
+		sendWork <- batch
+	}
+	close(sendWork)
+
+	go func() {
+		wg.Wait()
+		close(receiveWork)
+	}()
+
+	touched := make(map[int64]bool)
+	for delta := range receiveWork {
+		for fid := range delta {
+			touched[fid] = true
+		}
+		algo.mergeModelDeltas(delta)
+	}
+
+	algo.decayModel(touched)
+}
+
+func batchSamples(samples []*core.Sample, grainSize int) [][]*core.Sample {
+	if grainSize <= 0 {
+		grainSize = 1
+	}
+	batches := make([][]*core.Sample, 0, len(samples)/grainSize+1)
+	for i := 0; i < len(samples); i += grainSize {
+		end := i + grainSize
+		if end > len(samples) {
+			end = len(samples)
+		}
+		batches = append(batches, samples[i:end])
+	}
+	return batches
+}
+
+// trainBatch runs the existing per-sample EP update against a batch in
+// isolation (against a private copy of the weights it touches) and returns
+// the accumulated natural-parameter delta per feature, so callers can merge
+// many batches' results without workers stepping on each other's weights.
+// The only access it has into the shared algo.Model is the snapshot below,
+// which goes through algo.modelMu since it runs concurrently with other
+// workers' snapshots and with mergeModelDeltas writing results back from
+// other batches. The delta is computed against that same snapshot, not a
+// fresh read of algo.Model afterwards -- re-reading would pick up whatever
+// another worker's merge landed in the meantime and silently discard this
+// batch's contribution on top of it instead of adding to it.
+func (algo *EPLogisticRegression) trainBatch(batch []*core.Sample) map[int64]util.Gaussian {
+	deltas := make(map[int64]util.Gaussian)
+	base := make(map[int64]util.Gaussian)
+	local := &EPLogisticRegression{
+		Model:  make(map[int64]*util.Gaussian),
+		params: algo.params,
+	}
+
+	algo.modelMu.RLock()
+	for _, sample := range batch {
+		for _, feature := range sample.Features {
+			if feature.Value == 0.0 {
+				continue
+			}
+			if _, ok := local.Model[feature.Id]; !ok {
+				wi, ok := algo.Model[feature.Id]
+				if !ok {
+					wi = &util.Gaussian{Mean: 0.0, Vari: algo.params.init_var}
+				}
+				base[feature.Id] = *wi
+				cp := *wi
+				local.Model[feature.Id] = &cp
+			}
+		}
+	}
+	algo.modelMu.RUnlock()
+
+	local.train(&core.DataSet{Samples: batch}, false)
+
+	for fid, wi := range local.Model {
+		baseTau, basePi := gaussianToNatural(base[fid])
+		wiTau, wiPi := gaussianToNatural(*wi)
+		deltas[fid] = util.Gaussian{Mean: wiPi - basePi, Vari: wiTau - baseTau}
+	}
+	return deltas
+}
+
+// mergeModelDeltas combines a batch's natural-parameter deltas (tau stored
+// in Vari, pi stored in Mean, see trainBatch) additively into algo.Model.
+// It takes algo.modelMu for the whole merge, which is what actually keeps
+// this safe against trainBatch's reads above -- a per-shard lock here isn't
+// enough, since trainBatch's reads never went through it at all.
+func (algo *EPLogisticRegression) mergeModelDeltas(deltas map[int64]util.Gaussian) {
+	algo.modelMu.Lock()
+	defer algo.modelMu.Unlock()
+
+	for fid, delta := range deltas {
+		wi, ok := algo.Model[fid]
+		if !ok {
+			wi = &util.Gaussian{Mean: 0.0, Vari: algo.params.init_var}
+			algo.Model[fid] = wi
+		}
+		tau, pi := gaussianToNatural(*wi)
+		tau += delta.Vari
+		pi += delta.Mean
+		*wi = gaussianFromNatural(tau, pi)
+	}
+}
+
+// decayModel applies the eq-14/15 decay-to-prior step (see Train) once per
+// epoch, scoped to touched (the features merged into algo.Model by this
+// epoch's batches). Features the epoch never saw are left alone -- trainBatch
+// already skips the per-sample decay step Train normally does, so this is the
+// only decay TrainParallel applies.
+func (algo *EPLogisticRegression) decayModel(touched map[int64]bool) {
+	algo.modelMu.Lock()
+	defer algo.modelMu.Unlock()
+
+	for fid := range touched {
+		if wi, ok := algo.Model[fid]; ok {
+			algo.decayToPrior(wi, 0.99, 0.01)
+		}
+	}
+}
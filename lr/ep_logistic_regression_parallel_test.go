@@ -0,0 +1,54 @@
+package lr
+
+import (
+	"fmt"
+	"github.com/xlvector/hector/core"
+	"math/rand"
+	"testing"
+)
+
+func sparseDataset(numSamples, numFeatures, nnz int) *core.DataSet {
+	samples := make([]*core.Sample, numSamples)
+	for i := 0; i < numSamples; i++ {
+		features := make([]*core.Feature, nnz)
+		for j := 0; j < nnz; j++ {
+			features[j] = &core.Feature{Id: int64(rand.Intn(numFeatures)), Value: 1.0}
+		}
+		label := -1.0
+		if rand.Intn(2) == 1 {
+			label = 1.0
+		}
+		samples[i] = &core.Sample{Features: features, Label: label}
+	}
+	return &core.DataSet{Samples: samples}
+}
+
+// TestTrainParallelPopulatesModel is a smoke test that exercises the worker
+// pool end to end and checks the weights it touches land in algo.Model.
+func TestTrainParallelPopulatesModel(t *testing.T) {
+	dataset := sparseDataset(500, 2000, 10)
+	algo := &EPLogisticRegression{}
+	algo.Init(map[string]string{"beta": "1.0"})
+
+	algo.TrainParallel(dataset, 4, 50)
+
+	if len(algo.Model) == 0 {
+		t.Fatal("expected TrainParallel to populate algo.Model, got an empty model")
+	}
+}
+
+// BenchmarkTrainParallel demonstrates TrainParallel's scaling on a large
+// sparse dataset across worker counts.
+func BenchmarkTrainParallel(b *testing.B) {
+	dataset := sparseDataset(20000, 200000, 20)
+
+	for _, numWorkers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", numWorkers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				algo := &EPLogisticRegression{}
+				algo.Init(map[string]string{"beta": "1.0"})
+				algo.TrainParallel(dataset, numWorkers, 200)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package lr
+
+import (
+	"github.com/xlvector/hector/core"
+	"github.com/xlvector/hector/util"
+	"math"
+)
+
+// http://tullo.ch/articles/online-learning-with-adpredictor/
+//
+// Observe/PredictWithVariance let a caller drive the EP update one sample at
+// a time instead of batching through Train, mirroring the ADPredictor
+// online-learning pattern already cited there.
+
+// Observe runs the same EP update as the body of Train's loop against a
+// single sample.
+func (algo *EPLogisticRegression) Observe(sample *core.Sample) {
+	algo.modelMu.Lock()
+	defer algo.modelMu.Unlock()
+
+	s := util.Gaussian{Mean: 0.0, Vari: 0.0}
+	for _, feature := range sample.Features {
+		if feature.Value == 0.0 {
+			continue
+		}
+		wi, ok := algo.Model[feature.Id]
+		if !ok {
+			wi = &util.Gaussian{Mean: 0.0, Vari: algo.params.init_var}
+			algo.Model[feature.Id] = wi
+		}
+		s.Mean += feature.Value * wi.Mean
+		s.Vari += feature.Value * feature.Value * wi.Vari
+	}
+
+	t := s
+	t.Vari += algo.params.beta
+
+	t2 := util.Gaussian{Mean: 0.0, Vari: 0.0}
+	if sample.Label > 0.0 {
+		t2.UpperTruncateGaussian(t.Mean, t.Vari, 0.0)
+	} else {
+		t2.LowerTruncateGaussian(t.Mean, t.Vari, 0.0)
+	}
+	t.MultGaussian(&t2)
+	s2 := t
+	s2.Vari += algo.params.beta
+	s0 := s
+	s.MultGaussian(&s2)
+
+	for _, feature := range sample.Features {
+		if feature.Value == 0.0 {
+			continue
+		}
+		w2 := util.Gaussian{Mean: 0.0, Vari: 0.0}
+		wi := algo.Model[feature.Id]
+		w2.Mean = (s.Mean - (s0.Mean - wi.Mean*feature.Value)) / feature.Value
+		w2.Vari = (s.Vari + (s0.Vari - wi.Vari*feature.Value*feature.Value)) / (feature.Value * feature.Value)
+		wi.MultGaussian(&w2)
+
+		algo.decayToPrior(wi, 0.99, 0.01)
+		algo.Model[feature.Id] = wi
+	}
+}
+
+// PredictWithVariance returns both the mean and variance of the latent
+// Gaussian score for sample, before squashing it through Integral. The
+// variance is what ShouldQuery thresholds on. Like Predict, this never
+// mutates Model -- unseen features fall back to the prior in place -- so it
+// is safe to call concurrently from a serving loop while training runs.
+func (algo *EPLogisticRegression) PredictWithVariance(sample *core.Sample) (mean, variance float64) {
+	s := algo.scoreReadOnly(sample)
+	return s.Mean, s.Vari + algo.params.beta
+}
+
+// ShouldQuery reports whether sample's predictive variance exceeds
+// threshold, so an active-learning loop can request a label only for
+// examples the model is still uncertain about.
+func (algo *EPLogisticRegression) ShouldQuery(sample *core.Sample, threshold float64) bool {
+	_, variance := algo.PredictWithVariance(sample)
+	return variance > threshold
+}
+
+// DecayElapsed applies the eq-14/15 decay-to-prior step scaled by how long a
+// feature has gone unseen, so idle features drift back to the prior at rate
+// decayPerUnit instead of the fixed 0.99/0.01 split Train uses every sample.
+// elapsed is caller-defined units (e.g. seconds since the feature's last
+// Observe); decayPerUnit is the fraction of the way back to the prior per
+// unit of elapsed time.
+func (algo *EPLogisticRegression) DecayElapsed(featureId int64, elapsed float64, decayPerUnit float64) {
+	algo.modelMu.Lock()
+	defer algo.modelMu.Unlock()
+
+	wi, ok := algo.Model[featureId]
+	if !ok {
+		return
+	}
+	toPrior := 1 - math.Pow(1-decayPerUnit, elapsed)
+	if toPrior <= 0 {
+		return
+	}
+	if toPrior > 1 {
+		toPrior = 1
+	}
+	stay := 1 - toPrior
+	algo.decayToPrior(wi, stay, toPrior)
+}
@@ -0,0 +1,183 @@
+package lr
+
+import (
+	"github.com/xlvector/hector/core"
+	"github.com/xlvector/hector/util"
+	"math"
+)
+
+// http://www.moserware.com/2010/03/computing-your-skill.html
+//
+// Rank trains on pairs of samples (a, b) where the label indicates a beats
+// b, rather than on a single sample against a fixed threshold. The
+// truncated-Gaussian factor is applied to the difference of the two latent
+// scores s_a - s_b, same idea as TrueSkill's 1v1 game factor, with a
+// configurable draw margin epsilon.
+
+// SamplePair is one ranking observation: a beat b when Label > 0, b beat a
+// when Label < 0, and it was a draw when Label == 0 (only meaningful when
+// Epsilon > 0).
+type SamplePair struct {
+	A     *core.Sample
+	B     *core.Sample
+	Label float64
+}
+
+// score is the training-path variant: it materializes a fresh-prior entry in
+// algo.Model for every unseen feature id, same as Train/Observe, so the
+// weight exists to be updated afterwards. Only call this from a training
+// call site (Rank); prediction call sites must use scoreReadOnly instead, or
+// concurrent predictions and training will race on algo.Model.
+func (algo *EPLogisticRegression) score(sample *core.Sample) util.Gaussian {
+	algo.modelMu.Lock()
+	defer algo.modelMu.Unlock()
+
+	s := util.Gaussian{Mean: 0.0, Vari: 0.0}
+	for _, feature := range sample.Features {
+		if feature.Value == 0.0 {
+			continue
+		}
+		wi, ok := algo.Model[feature.Id]
+		if !ok {
+			wi = &util.Gaussian{Mean: 0.0, Vari: algo.params.init_var}
+			algo.Model[feature.Id] = wi
+		}
+		s.Mean += feature.Value * wi.Mean
+		s.Vari += feature.Value * feature.Value * wi.Vari
+	}
+	return s
+}
+
+// scoreReadOnly computes the same latent-score Gaussian as score but never
+// writes to algo.Model: an unseen feature just falls back to the prior
+// in-place instead of being inserted. Use this from prediction/serving call
+// sites (PredictPair, PredictWithVariance, ShouldQuery) that can be called
+// concurrently and must not mutate shared state just by being asked for a
+// prediction.
+func (algo *EPLogisticRegression) scoreReadOnly(sample *core.Sample) util.Gaussian {
+	algo.modelMu.RLock()
+	defer algo.modelMu.RUnlock()
+
+	s := util.Gaussian{Mean: 0.0, Vari: 0.0}
+	for _, feature := range sample.Features {
+		if feature.Value == 0.0 {
+			continue
+		}
+		mean, vari := 0.0, algo.params.init_var
+		if wi, ok := algo.Model[feature.Id]; ok {
+			mean, vari = wi.Mean, wi.Vari
+		}
+		s.Mean += feature.Value * mean
+		s.Vari += feature.Value * feature.Value * vari
+	}
+	return s
+}
+
+// Rank runs one EP pass over pairs, updating every feature weight that
+// appears in either sample of each pair.
+func (algo *EPLogisticRegression) Rank(pairs []*SamplePair, epsilon float64) {
+	for _, pair := range pairs {
+		sa := algo.score(pair.A)
+		sb := algo.score(pair.B)
+
+		// difference of latent scores, each with its own beta "performance
+		// noise" added, same as the 2*beta term in TrueSkill's 1v1 factor
+		d := util.Gaussian{
+			Mean: sa.Mean - sb.Mean,
+			Vari: sa.Vari + sb.Vari + 2*algo.params.beta,
+		}
+
+		denom := math.Sqrt(d.Vari)
+		t := d.Mean / denom
+		eps := epsilon / denom
+
+		var v, w float64
+		draw := epsilon > 0.0 && pair.Label == 0.0
+		switch {
+		case draw:
+			v = vDraw(t, eps)
+			w = wDraw(t, eps)
+		case pair.Label > 0.0:
+			v = vGreater(t, eps)
+			w = wGreater(t, eps)
+		default:
+			v = vLess(t, eps)
+			w = wLess(t, eps)
+		}
+
+		newMean := d.Mean + denom*v
+		newVari := d.Vari * (1 - w)
+		if newVari <= 0 {
+			newVari = 1e-10
+		}
+		truncated := util.Gaussian{Mean: newMean, Vari: newVari}
+		msg := gaussianDiv(truncated, d)
+
+		algo.applyPairUpdate(pair.A, msg, 1.0)
+		algo.applyPairUpdate(pair.B, msg, -1.0)
+	}
+}
+
+// applyPairUpdate folds the message computed against the score difference
+// back onto every feature weight in sample, same division-of-messages step
+// as the inner loop of Train, with sign flipped for the losing side since
+// its score contributes as -s_b to the difference.
+func (algo *EPLogisticRegression) applyPairUpdate(sample *core.Sample, msg util.Gaussian, sign float64) {
+	algo.modelMu.Lock()
+	defer algo.modelMu.Unlock()
+
+	for _, feature := range sample.Features {
+		if feature.Value == 0.0 {
+			continue
+		}
+		wi := algo.Model[feature.Id]
+		coeff := sign * feature.Value
+
+		w2 := util.Gaussian{
+			Mean: msg.Mean / coeff,
+			Vari: msg.Vari / (coeff * coeff),
+		}
+		wi.MultGaussian(&w2)
+		algo.decayToPrior(wi, 0.99, 0.01)
+	}
+}
+
+// PredictPair returns P(a beats b) and the match quality (probability the
+// pair is a draw under margin epsilon), using the same latent-score
+// difference as Rank but without updating any weights.
+func (algo *EPLogisticRegression) PredictPair(a, b *core.Sample, epsilon float64) (pWin, pDraw float64) {
+	sa := algo.scoreReadOnly(a)
+	sb := algo.scoreReadOnly(b)
+
+	d := util.Gaussian{
+		Mean: sa.Mean - sb.Mean,
+		Vari: sa.Vari + sb.Vari + 2*algo.params.beta,
+	}
+	denom := math.Sqrt(d.Vari)
+
+	pWin = normCdf((d.Mean - epsilon) / denom)
+	pDraw = normCdf((epsilon-d.Mean)/denom) - normCdf((-epsilon-d.Mean)/denom)
+	return
+}
+
+// vDraw/wDraw are TrueSkill's draw-case correction functions: the quality of
+// a draw as the latent score difference t moves away from 0, bounded by the
+// draw margin epsilon.
+func vDraw(t, epsilon float64) float64 {
+	num := normPdf(-epsilon-t) - normPdf(epsilon-t)
+	denom := normCdf(epsilon-t) - normCdf(-epsilon-t)
+	if denom < 1e-10 {
+		return 0.0
+	}
+	return num / denom
+}
+
+func wDraw(t, epsilon float64) float64 {
+	v := vDraw(t, epsilon)
+	num := (epsilon-t)*normPdf(epsilon-t) + (epsilon+t)*normPdf(-epsilon-t)
+	denom := normCdf(epsilon-t) - normCdf(-epsilon-t)
+	if denom < 1e-10 {
+		return v * v
+	}
+	return v*v + num/denom
+}
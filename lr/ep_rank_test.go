@@ -0,0 +1,82 @@
+package lr
+
+import (
+	"github.com/xlvector/hector/core"
+	"testing"
+)
+
+func rankSample(featureId int64, value float64) *core.Sample {
+	return &core.Sample{Features: []*core.Feature{{Id: featureId, Value: value}}}
+}
+
+// TestRankMovesWinnerWeightUp checks that after repeatedly observing the same
+// feature win, its weight moves in the direction that explains the outcome
+// (up, since A's feature fires and A keeps beating B).
+func TestRankMovesWinnerWeightUp(t *testing.T) {
+	algo := &EPLogisticRegression{}
+	algo.Init(map[string]string{"beta": "1.0"})
+
+	a := rankSample(1, 1.0)
+	b := rankSample(2, 1.0)
+	pairs := []*SamplePair{{A: a, B: b, Label: 1.0}}
+
+	for i := 0; i < 50; i++ {
+		algo.Rank(pairs, 0.0)
+	}
+
+	wa := algo.Model[1]
+	wb := algo.Model[2]
+	if wa == nil || wb == nil {
+		t.Fatal("expected Rank to populate weights for both features")
+	}
+	if wa.Mean <= wb.Mean {
+		t.Fatalf("expected winner's weight (%v) to end up above loser's (%v)", wa.Mean, wb.Mean)
+	}
+}
+
+// TestPredictPairAgreesWithRank checks PredictPair reports the trained winner
+// as more likely to win, without itself mutating Model.
+func TestPredictPairAgreesWithRank(t *testing.T) {
+	algo := &EPLogisticRegression{}
+	algo.Init(map[string]string{"beta": "1.0"})
+
+	a := rankSample(1, 1.0)
+	b := rankSample(2, 1.0)
+	pairs := []*SamplePair{{A: a, B: b, Label: 1.0}}
+	for i := 0; i < 50; i++ {
+		algo.Rank(pairs, 0.0)
+	}
+
+	before := len(algo.Model)
+	pWin, _ := algo.PredictPair(a, b, 0.0)
+	if len(algo.Model) != before {
+		t.Fatalf("expected PredictPair to leave Model untouched, had %d features, now %d", before, len(algo.Model))
+	}
+	if pWin <= 0.5 {
+		t.Fatalf("expected trained winner to be favored, got pWin=%v", pWin)
+	}
+}
+
+// TestRankDrawKeepsWeightsClose checks that a draw margin wide enough to
+// cover every observed outcome leaves both weights close to each other.
+func TestRankDrawKeepsWeightsClose(t *testing.T) {
+	algo := &EPLogisticRegression{}
+	algo.Init(map[string]string{"beta": "1.0"})
+
+	a := rankSample(1, 1.0)
+	b := rankSample(2, 1.0)
+	pairs := []*SamplePair{{A: a, B: b, Label: 0.0}}
+
+	for i := 0; i < 50; i++ {
+		algo.Rank(pairs, 10.0)
+	}
+
+	wa := algo.Model[1]
+	wb := algo.Model[2]
+	if wa == nil || wb == nil {
+		t.Fatal("expected Rank to populate weights for both features")
+	}
+	if diff := wa.Mean - wb.Mean; diff > 0.1 || diff < -0.1 {
+		t.Fatalf("expected a wide-margin draw to leave weights close together, got %v vs %v", wa.Mean, wb.Mean)
+	}
+}
@@ -0,0 +1,368 @@
+package lr
+
+import (
+	"github.com/xlvector/hector/util"
+	"math"
+)
+
+// http://www.moserware.com/2010/03/computing-your-skill.html
+// http://research.microsoft.com/en-us/um/people/minka/papers/ep/minka-ep-uai.pdf
+// https://www.microsoft.com/en-us/research/project/trueskill-ranking-system/
+//
+// FactorGraphEP runs loopy Gaussian expectation propagation over an explicit
+// factor graph. Unlike the hand-rolled single-pass update in Train, the same
+// scheduler works for any graph built out of Factor nodes, so ranking,
+// multi-class and ordinal-regression models can reuse it.
+
+// DistributionBag is an indexed slab of Gaussians. Factors refer to their
+// marginals/messages by index rather than holding pointers directly, so the
+// graph can be serialized or resized without invalidating references.
+type DistributionBag struct {
+	slabs []util.Gaussian
+}
+
+func NewDistributionBag() *DistributionBag {
+	return &DistributionBag{slabs: make([]util.Gaussian, 0)}
+}
+
+// Put appends g to the bag and returns its index.
+func (bag *DistributionBag) Put(g util.Gaussian) int {
+	bag.slabs = append(bag.slabs, g)
+	return len(bag.slabs) - 1
+}
+
+func (bag *DistributionBag) Get(idx int) util.Gaussian {
+	return bag.slabs[idx]
+}
+
+func (bag *DistributionBag) Set(idx int, g util.Gaussian) {
+	bag.slabs[idx] = g
+}
+
+// Mul multiplies the slab at idx by g in place and returns the result.
+func (bag *DistributionBag) Mul(idx int, g util.Gaussian) util.Gaussian {
+	cur := bag.slabs[idx]
+	cur.MultGaussian(&g)
+	bag.slabs[idx] = cur
+	return cur
+}
+
+// Div divides the slab at idx by g in place and returns the result. Division
+// is multiplication by the inverse in natural (precision) parameters.
+func (bag *DistributionBag) Div(idx int, g util.Gaussian) util.Gaussian {
+	tau, pi := gaussianToNatural(bag.slabs[idx])
+	gtau, gpi := gaussianToNatural(g)
+	bag.slabs[idx] = gaussianFromNatural(tau-gtau, pi-gpi)
+	return bag.slabs[idx]
+}
+
+// MessageBag pairs the per-variable marginals with the per-edge messages
+// flowing into them, which is all a Factor needs to update itself.
+type MessageBag struct {
+	Marginals *DistributionBag
+	Messages  *DistributionBag
+}
+
+func NewMessageBag() *MessageBag {
+	return &MessageBag{
+		Marginals: NewDistributionBag(),
+		Messages:  NewDistributionBag(),
+	}
+}
+
+// AddVariable registers a new variable with an initial marginal (usually the
+// prior) and returns its index into Marginals.
+func (mb *MessageBag) AddVariable(init util.Gaussian) int {
+	return mb.Marginals.Put(init)
+}
+
+// AddEdge registers a new factor-variable edge, seeded with a vacuous message
+// (infinite variance, i.e. no information yet), and returns its index into
+// Messages.
+func (mb *MessageBag) AddEdge() int {
+	return mb.Messages.Put(util.Gaussian{Mean: 0.0, Vari: math.Inf(1)})
+}
+
+// Factor is one node of the graph. UpdateMessage recomputes the message(s)
+// this factor sends out, applies them via SendMessage and returns the max
+// absolute change in message precision, which the scheduler uses to detect
+// convergence. LogNormalization returns this factor's contribution to the
+// overall log-evidence once the graph has converged.
+type Factor interface {
+	UpdateMessage(mb *MessageBag) float64
+	SendMessage(mb *MessageBag, varIdx, msgIdx int, msg util.Gaussian)
+	LogNormalization(mb *MessageBag) float64
+}
+
+// factorBase implements the SendMessage closure shared by every factor type:
+// divide the variable's old message back out of its marginal, multiply in
+// the new message, and report the precision delta.
+type factorBase struct{}
+
+func (factorBase) SendMessage(mb *MessageBag, varIdx, msgIdx int, msg util.Gaussian) float64 {
+	old := mb.Messages.Get(msgIdx)
+	mb.Marginals.Div(varIdx, old)
+	mb.Marginals.Mul(varIdx, msg)
+	mb.Messages.Set(msgIdx, msg)
+
+	oldTau, _ := gaussianToNatural(old)
+	newTau, _ := gaussianToNatural(msg)
+	delta := math.Abs(newTau - oldTau)
+	if math.IsInf(delta, 0) || math.IsNaN(delta) {
+		delta = 0.0
+	}
+	return delta
+}
+
+// GaussianPriorFactor pins a variable to a fixed Gaussian prior. It never
+// changes after the first pass, so it contributes zero to convergence deltas.
+type GaussianPriorFactor struct {
+	factorBase
+	VarIdx int
+	MsgIdx int
+	Prior  util.Gaussian
+}
+
+func (f *GaussianPriorFactor) UpdateMessage(mb *MessageBag) float64 {
+	return f.factorBase.SendMessage(mb, f.VarIdx, f.MsgIdx, f.Prior)
+}
+
+func (f *GaussianPriorFactor) SendMessage(mb *MessageBag, varIdx, msgIdx int, msg util.Gaussian) {
+	f.factorBase.SendMessage(mb, varIdx, msgIdx, msg)
+}
+
+func (f *GaussianPriorFactor) LogNormalization(mb *MessageBag) float64 {
+	return 0.0
+}
+
+// GaussianLikelihoodFactor implements the weighted-sum "clutter" factor used
+// to turn a set of feature weights into a latent score s = sum_i w_i*x_i,
+// with Beta the noise variance injected at this layer (see eq. in Train).
+type GaussianLikelihoodFactor struct {
+	factorBase
+	InputIdx    []int
+	InputMsgIdx []int
+	Weights     []float64
+	OutputIdx   int
+	OutputMsgIdx int
+	Beta        float64
+}
+
+// UpdateMessage pushes the forward sum message to OutputIdx, same as before,
+// but now also pushes the missing backward message to each input: the
+// output cavity (what the rest of the graph, e.g. a GaussianGreaterThanFactor,
+// believes about the sum) with every other input's contribution subtracted
+// out and divided down by this input's weight. Without this half, nothing
+// downstream of the sum can ever change an input's marginal away from
+// whatever GaussianPriorFactor set it to.
+func (f *GaussianLikelihoodFactor) UpdateMessage(mb *MessageBag) float64 {
+	cavities := make([]util.Gaussian, len(f.InputIdx))
+	s := util.Gaussian{Mean: 0.0, Vari: f.Beta}
+	for i, varIdx := range f.InputIdx {
+		m := mb.Marginals.Get(varIdx)
+		old := mb.Messages.Get(f.InputMsgIdx[i])
+		// the marginal already includes this edge's own message, so divide
+		// it back out before projecting the input down into the sum
+		cavities[i] = gaussianDiv(m, old)
+		w := f.Weights[i]
+		s.Mean += w * cavities[i].Mean
+		s.Vari += w * w * cavities[i].Vari
+	}
+
+	maxDelta := f.factorBase.SendMessage(mb, f.OutputIdx, f.OutputMsgIdx, s)
+
+	// outCavity = what's known about the sum from every other factor touching
+	// OutputIdx (e.g. a GreaterThanFactor). Dividing the marginal we just set
+	// by the message we just sent cancels our own contribution back out,
+	// regardless of send order.
+	outCavity := gaussianDiv(mb.Marginals.Get(f.OutputIdx), mb.Messages.Get(f.OutputMsgIdx))
+
+	sNoBeta := util.Gaussian{Mean: s.Mean, Vari: s.Vari - f.Beta}
+	for i, varIdx := range f.InputIdx {
+		w := f.Weights[i]
+		if w == 0.0 {
+			continue
+		}
+		// the rest of the weighted sum, i.e. the sum with input i removed
+		others := util.Gaussian{
+			Mean: sNoBeta.Mean - w*cavities[i].Mean,
+			Vari: sNoBeta.Vari - w*w*cavities[i].Vari,
+		}
+		// w_i*x_i = output - others - noise, and subtracting independent
+		// Gaussians adds variances
+		wTimesX := util.Gaussian{
+			Mean: outCavity.Mean - others.Mean,
+			Vari: outCavity.Vari + others.Vari + f.Beta,
+		}
+		msg := util.Gaussian{Mean: wTimesX.Mean / w, Vari: wTimesX.Vari / (w * w)}
+
+		delta := f.factorBase.SendMessage(mb, varIdx, f.InputMsgIdx[i], msg)
+		if delta > maxDelta {
+			maxDelta = delta
+		}
+	}
+	return maxDelta
+}
+
+func (f *GaussianLikelihoodFactor) SendMessage(mb *MessageBag, varIdx, msgIdx int, msg util.Gaussian) {
+	f.factorBase.SendMessage(mb, varIdx, msgIdx, msg)
+}
+
+func (f *GaussianLikelihoodFactor) LogNormalization(mb *MessageBag) float64 {
+	return 0.0
+}
+
+// GaussianGreaterThanFactor truncates a variable's marginal to the region
+// x > epsilon (or x < -epsilon when GreaterThan is false), using the
+// standard EP v/w correction functions. epsilon is 0 for plain binary
+// classification and the TrueSkill draw margin for ranking.
+type GaussianGreaterThanFactor struct {
+	factorBase
+	VarIdx      int
+	MsgIdx      int
+	Epsilon     float64
+	GreaterThan bool
+	logZ        float64
+}
+
+func (f *GaussianGreaterThanFactor) UpdateMessage(mb *MessageBag) float64 {
+	marginal := mb.Marginals.Get(f.VarIdx)
+	old := mb.Messages.Get(f.MsgIdx)
+	cavity := gaussianDiv(marginal, old)
+
+	t := cavity.Mean
+	denom := math.Sqrt(cavity.Vari)
+	var v, w, logZ float64
+	if f.GreaterThan {
+		v = vGreater(t/denom, f.Epsilon/denom)
+		w = wGreater(t/denom, f.Epsilon/denom)
+		logZ = math.Log(normCdf((t - f.Epsilon) / denom))
+	} else {
+		v = vLess(t/denom, f.Epsilon/denom)
+		w = wLess(t/denom, f.Epsilon/denom)
+		logZ = math.Log(normCdf((-t - f.Epsilon) / denom))
+	}
+	f.logZ = logZ
+
+	newMean := cavity.Mean + denom*v
+	newVari := cavity.Vari * (1 - w)
+	if newVari <= 0 {
+		newVari = 1e-10
+	}
+	truncated := util.Gaussian{Mean: newMean, Vari: newVari}
+	msg := gaussianDiv(truncated, cavity)
+
+	return f.factorBase.SendMessage(mb, f.VarIdx, f.MsgIdx, msg)
+}
+
+func (f *GaussianGreaterThanFactor) SendMessage(mb *MessageBag, varIdx, msgIdx int, msg util.Gaussian) {
+	f.factorBase.SendMessage(mb, varIdx, msgIdx, msg)
+}
+
+func (f *GaussianGreaterThanFactor) LogNormalization(mb *MessageBag) float64 {
+	return f.logZ
+}
+
+// FactorGraphEP owns the graph and runs the convergence loop.
+type FactorGraphEP struct {
+	Factors       []Factor
+	Bag           *MessageBag
+	Tolerance     float64
+	MaxIterations int
+}
+
+func NewFactorGraphEP(bag *MessageBag) *FactorGraphEP {
+	return &FactorGraphEP{
+		Bag:           bag,
+		Tolerance:     1e-4,
+		MaxIterations: 20,
+	}
+}
+
+func (fg *FactorGraphEP) AddFactor(f Factor) {
+	fg.Factors = append(fg.Factors, f)
+}
+
+// Run iterates UpdateMessage across every factor until the max absolute
+// change in message precision falls below Tolerance (or MaxIterations is
+// hit), then returns the accumulated log-evidence from LogNormalization.
+func (fg *FactorGraphEP) Run() float64 {
+	for iter := 0; iter < fg.MaxIterations; iter++ {
+		maxDelta := 0.0
+		for _, f := range fg.Factors {
+			delta := f.UpdateMessage(fg.Bag)
+			if delta > maxDelta {
+				maxDelta = delta
+			}
+		}
+		if maxDelta < fg.Tolerance {
+			break
+		}
+	}
+
+	logEvidence := 0.0
+	for _, f := range fg.Factors {
+		logEvidence += f.LogNormalization(fg.Bag)
+	}
+	return logEvidence
+}
+
+// gaussianToNatural converts a Gaussian from moment form (mean, variance) to
+// natural/precision form (tau = 1/variance, pi = mean*tau).
+func gaussianToNatural(g util.Gaussian) (tau, pi float64) {
+	tau = 1.0 / g.Vari
+	pi = g.Mean * tau
+	return
+}
+
+func gaussianFromNatural(tau, pi float64) util.Gaussian {
+	if tau <= 0 {
+		// no precision left at all (e.g. dividing a vacuous message out of a
+		// vacuous marginal during the first pass): 0 * (1/0) is NaN in
+		// IEEE754, but the Gaussian this represents is just vacuous.
+		return util.Gaussian{Mean: 0.0, Vari: math.Inf(1)}
+	}
+	vari := 1.0 / tau
+	return util.Gaussian{Mean: pi * vari, Vari: vari}
+}
+
+// gaussianDiv divides a by b (moment form), i.e. subtracts b's natural
+// parameters from a's. Used to move from a marginal to its cavity.
+func gaussianDiv(a, b util.Gaussian) util.Gaussian {
+	aTau, aPi := gaussianToNatural(a)
+	bTau, bPi := gaussianToNatural(b)
+	return gaussianFromNatural(aTau-bTau, aPi-bPi)
+}
+
+func normPdf(x float64) float64 {
+	return math.Exp(-x*x/2.0) / math.Sqrt(2.0*math.Pi)
+}
+
+func normCdf(x float64) float64 {
+	return 0.5 * math.Erfc(-x/math.Sqrt2)
+}
+
+// vGreater/wGreater are the standard EP correction functions for truncating
+// a Gaussian to the region t > epsilon: v(t)=phi(t-eps)/Phi(t-eps),
+// w(t)=v(t)*(v(t)+t-eps).
+func vGreater(t, epsilon float64) float64 {
+	denom := normCdf(t - epsilon)
+	if denom < 1e-10 {
+		return -(t - epsilon)
+	}
+	return normPdf(t-epsilon) / denom
+}
+
+func wGreater(t, epsilon float64) float64 {
+	v := vGreater(t, epsilon)
+	return v * (v + t - epsilon)
+}
+
+// vLess/wLess are the symmetric versions for truncating to t < -epsilon.
+func vLess(t, epsilon float64) float64 {
+	return -vGreater(-t, epsilon)
+}
+
+func wLess(t, epsilon float64) float64 {
+	return wGreater(-t, epsilon)
+}
@@ -0,0 +1,57 @@
+package lr
+
+import (
+	"github.com/xlvector/hector/util"
+	"math"
+	"testing"
+)
+
+// TestGaussianLikelihoodFactorLearnsWeight builds the smallest graph that
+// exercises a backward message: a single weight w with an N(0, 1) prior
+// (its marginal starts vacuous), combined through a likelihood factor (output = w, beta noise only) and
+// constrained to be greater than zero. If the likelihood factor only sent
+// its forward message (the bug this test guards against), w's marginal
+// would never move from its prior.
+func TestGaussianLikelihoodFactorLearnsWeight(t *testing.T) {
+	vacuous := util.Gaussian{Mean: 0.0, Vari: math.Inf(1)}
+
+	bag := NewMessageBag()
+	wIdx := bag.AddVariable(vacuous)
+	wPriorMsgIdx := bag.AddEdge()
+	wLikelihoodMsgIdx := bag.AddEdge()
+
+	outIdx := bag.AddVariable(vacuous)
+	outFwdMsgIdx := bag.AddEdge()
+	outGTMsgIdx := bag.AddEdge()
+
+	fg := NewFactorGraphEP(bag)
+	fg.AddFactor(&GaussianPriorFactor{
+		VarIdx: wIdx,
+		MsgIdx: wPriorMsgIdx,
+		Prior:  util.Gaussian{Mean: 0.0, Vari: 1.0},
+	})
+	fg.AddFactor(&GaussianLikelihoodFactor{
+		InputIdx:     []int{wIdx},
+		InputMsgIdx:  []int{wLikelihoodMsgIdx},
+		Weights:      []float64{1.0},
+		OutputIdx:    outIdx,
+		OutputMsgIdx: outFwdMsgIdx,
+		Beta:         0.1,
+	})
+	fg.AddFactor(&GaussianGreaterThanFactor{
+		VarIdx:      outIdx,
+		MsgIdx:      outGTMsgIdx,
+		Epsilon:     0.0,
+		GreaterThan: true,
+	})
+
+	fg.Run()
+
+	wMarginal := bag.Marginals.Get(wIdx)
+	if wMarginal.Mean <= 0.0 {
+		t.Fatalf("expected w's marginal mean to move above its 0 prior after a >0 constraint on the output, got %v", wMarginal.Mean)
+	}
+	if wMarginal.Vari >= 1.0 {
+		t.Fatalf("expected w's marginal variance to shrink below its 1.0 prior after evidence, got %v", wMarginal.Vari)
+	}
+}
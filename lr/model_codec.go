@@ -0,0 +1,260 @@
+package lr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/xlvector/hector/util"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ModelCodec encodes/decodes an EPLogisticRegression's weights plus its
+// Params block (beta, init_var), so a loaded model round-trips everything
+// Predict needs instead of just the raw weights.
+type ModelCodec interface {
+	Encode(w io.Writer, algo *EPLogisticRegression) error
+	Decode(r io.Reader) (*EPLogisticRegression, error)
+	Magic() uint32
+}
+
+// Magic numbers identify the body format so LoadModel can dispatch without
+// the caller having to remember which codec wrote a given file.
+const (
+	magicText   uint32 = 0x48435401
+	magicGob    uint32 = 0x48435402
+	magicVarint uint32 = 0x48435403
+)
+
+func codecForMagic(magic uint32) (ModelCodec, error) {
+	switch magic {
+	case magicText:
+		return TextModelCodec{}, nil
+	case magicGob:
+		return GobModelCodec{}, nil
+	case magicVarint:
+		return VarintModelCodec{}, nil
+	default:
+		return nil, fmt.Errorf("lr: unrecognized model magic 0x%x", magic)
+	}
+}
+
+func newDecodedModel(beta, initVar float64) *EPLogisticRegression {
+	return &EPLogisticRegression{
+		Model: make(map[int64]*util.Gaussian),
+		params: EPLogisticRegressionParams{
+			beta:     beta,
+			init_var: initVar,
+		},
+	}
+}
+
+// TextModelCodec is the original tab-separated format, extended with a
+// leading "beta\tinit_var" line so Params round-trips too.
+type TextModelCodec struct{}
+
+func (TextModelCodec) Magic() uint32 { return magicText }
+
+func (TextModelCodec) Encode(w io.Writer, algo *EPLogisticRegression) error {
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(bw, "%v\t%v\n", algo.params.beta, algo.params.init_var); err != nil {
+		return err
+	}
+	for f, g := range algo.Model {
+		if _, err := fmt.Fprintf(bw, "%d\t%v\t%v\n", f, g.Mean, g.Vari); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (TextModelCodec) Decode(r io.Reader) (*EPLogisticRegression, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		return nil, errors.New("lr: empty text model")
+	}
+	header := strings.Split(scanner.Text(), "\t")
+	if len(header) != 2 {
+		return nil, errors.New("lr: malformed text model params line")
+	}
+	beta, _ := strconv.ParseFloat(header[0], 64)
+	initVar, _ := strconv.ParseFloat(header[1], 64)
+	algo := newDecodedModel(beta, initVar)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		tks := strings.Split(line, "\t")
+		fid, _ := strconv.ParseInt(tks[0], 10, 64)
+		mean, _ := strconv.ParseFloat(tks[1], 64)
+		vari, _ := strconv.ParseFloat(tks[2], 64)
+		algo.Model[fid] = &util.Gaussian{Mean: mean, Vari: vari}
+	}
+	return algo, scanner.Err()
+}
+
+// GobModelCodec stores Params and weights as plain gob-encoded Go values.
+type GobModelCodec struct{}
+
+func (GobModelCodec) Magic() uint32 { return magicGob }
+
+type gobModel struct {
+	Beta    float64
+	InitVar float64
+	Weights map[int64]util.Gaussian
+}
+
+func (GobModelCodec) Encode(w io.Writer, algo *EPLogisticRegression) error {
+	gm := gobModel{
+		Beta:    algo.params.beta,
+		InitVar: algo.params.init_var,
+		Weights: make(map[int64]util.Gaussian, len(algo.Model)),
+	}
+	for fid, g := range algo.Model {
+		gm.Weights[fid] = *g
+	}
+	return gob.NewEncoder(w).Encode(&gm)
+}
+
+func (GobModelCodec) Decode(r io.Reader) (*EPLogisticRegression, error) {
+	var gm gobModel
+	if err := gob.NewDecoder(r).Decode(&gm); err != nil {
+		return nil, err
+	}
+	algo := newDecodedModel(gm.Beta, gm.InitVar)
+	for fid, g := range gm.Weights {
+		cp := g
+		algo.Model[fid] = &cp
+	}
+	return algo, nil
+}
+
+// VarintModelCodec is the compact on-disk format for models with millions
+// of features: feature ids are delta-encoded varints (the map is walked in
+// sorted order), means are float32, and variances are quantized to float16
+// since they don't need full precision to be useful at Predict time.
+type VarintModelCodec struct{}
+
+func (VarintModelCodec) Magic() uint32 { return magicVarint }
+
+func (VarintModelCodec) Encode(w io.Writer, algo *EPLogisticRegression) error {
+	bw := bufio.NewWriter(w)
+	if err := binary.Write(bw, binary.BigEndian, algo.params.beta); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.BigEndian, algo.params.init_var); err != nil {
+		return err
+	}
+
+	ids := make([]int64, 0, len(algo.Model))
+	for fid := range algo.Model {
+		ids = append(ids, fid)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(ids)))
+	if _, err := bw.Write(buf[:n]); err != nil {
+		return err
+	}
+
+	prev := int64(0)
+	for _, fid := range ids {
+		n := binary.PutUvarint(buf[:], uint64(fid-prev))
+		if _, err := bw.Write(buf[:n]); err != nil {
+			return err
+		}
+		prev = fid
+
+		g := algo.Model[fid]
+		if err := binary.Write(bw, binary.BigEndian, float32(g.Mean)); err != nil {
+			return err
+		}
+		if err := binary.Write(bw, binary.BigEndian, float32ToFloat16(float32(g.Vari))); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (VarintModelCodec) Decode(r io.Reader) (*EPLogisticRegression, error) {
+	br := bufio.NewReader(r)
+
+	var beta, initVar float64
+	if err := binary.Read(br, binary.BigEndian, &beta); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(br, binary.BigEndian, &initVar); err != nil {
+		return nil, err
+	}
+	algo := newDecodedModel(beta, initVar)
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	fid := int64(0)
+	for i := uint64(0); i < count; i++ {
+		delta, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		fid += int64(delta)
+
+		var mean float32
+		if err := binary.Read(br, binary.BigEndian, &mean); err != nil {
+			return nil, err
+		}
+		var vari16 uint16
+		if err := binary.Read(br, binary.BigEndian, &vari16); err != nil {
+			return nil, err
+		}
+		algo.Model[fid] = &util.Gaussian{
+			Mean: float64(mean),
+			Vari: float64(float16ToFloat32(vari16)),
+		}
+	}
+	return algo, nil
+}
+
+// float32ToFloat16/float16ToFloat32 convert to/from IEEE 754 half precision.
+// Variance values here are always non-negative and rarely need more than a
+// few significant bits, so the reduced range is an acceptable tradeoff for
+// halving the on-disk size of the largest part of the model.
+func float32ToFloat16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16((bits >> 16) & 0x8000)
+	exp := int32((bits>>23)&0xff) - 127 + 15
+	mantissa := bits & 0x7fffff
+
+	if exp <= 0 {
+		return sign
+	}
+	if exp >= 0x1f {
+		return sign | 0x7c00
+	}
+	return sign | uint16(exp)<<10 | uint16(mantissa>>13)
+}
+
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h&0x7c00) >> 10
+	mantissa := uint32(h & 0x3ff)
+
+	if exp == 0 {
+		return math.Float32frombits(sign)
+	}
+	if exp == 0x1f {
+		return math.Float32frombits(sign | 0x7f800000 | (mantissa << 13))
+	}
+	bits := sign | ((exp - 15 + 127) << 23) | (mantissa << 13)
+	return math.Float32frombits(bits)
+}
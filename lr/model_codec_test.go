@@ -0,0 +1,79 @@
+package lr
+
+import (
+	"github.com/xlvector/hector/util"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+func sampleModel() *EPLogisticRegression {
+	algo := newDecodedModel(0.3, 2.5)
+	algo.Model[1] = &util.Gaussian{Mean: 0.125, Vari: 0.75}
+	algo.Model[2] = &util.Gaussian{Mean: -1.5, Vari: 2.0}
+	algo.Model[1000] = &util.Gaussian{Mean: 0.0, Vari: 2.5}
+	return algo
+}
+
+// TestModelCodecRoundTrip checks that SaveModelWithCodec/loadModel round-trip
+// Params and weights for every ModelCodec, through the real magic-number
+// header + CRC32 trailer that LoadModel dispatches on. VarintModelCodec
+// quantizes means to float32 and variances to float16, so it gets a looser
+// tolerance than the lossless text/gob codecs.
+func TestModelCodecRoundTrip(t *testing.T) {
+	cases := []struct {
+		name  string
+		codec ModelCodec
+		tol   float64
+	}{
+		{"text", TextModelCodec{}, 1e-9},
+		{"gob", GobModelCodec{}, 0},
+		{"varint", VarintModelCodec{}, 1e-2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			algo := sampleModel()
+
+			f, err := ioutil.TempFile("", "hector-model-*.bin")
+			if err != nil {
+				t.Fatalf("TempFile: %v", err)
+			}
+			path := f.Name()
+			f.Close()
+			defer os.Remove(path)
+
+			if err := algo.SaveModelWithCodec(path, c.codec); err != nil {
+				t.Fatalf("SaveModelWithCodec: %v", err)
+			}
+
+			decoded := &EPLogisticRegression{}
+			if err := decoded.loadModel(path); err != nil {
+				t.Fatalf("loadModel: %v", err)
+			}
+
+			if math.Abs(decoded.params.beta-algo.params.beta) > c.tol {
+				t.Fatalf("beta mismatch: got %v, want %v", decoded.params.beta, algo.params.beta)
+			}
+			if math.Abs(decoded.params.init_var-algo.params.init_var) > c.tol {
+				t.Fatalf("init_var mismatch: got %v, want %v", decoded.params.init_var, algo.params.init_var)
+			}
+			if len(decoded.Model) != len(algo.Model) {
+				t.Fatalf("expected %d features, got %d", len(algo.Model), len(decoded.Model))
+			}
+			for fid, want := range algo.Model {
+				got, ok := decoded.Model[fid]
+				if !ok {
+					t.Fatalf("missing feature %d after round-trip", fid)
+				}
+				if math.Abs(got.Mean-want.Mean) > c.tol {
+					t.Fatalf("feature %d mean: got %v, want %v", fid, got.Mean, want.Mean)
+				}
+				if math.Abs(got.Vari-want.Vari) > c.tol {
+					t.Fatalf("feature %d vari: got %v, want %v", fid, got.Vari, want.Vari)
+				}
+			}
+		})
+	}
+}